@@ -0,0 +1,74 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	mtime   time.Time
+	size    int64
+	matcher *Matcher
+}
+
+// Cache holds compiled Matchers for ignore files, keyed by their absolute
+// path, and recompiles an entry only when the underlying file's mtime or
+// size has changed. It is safe for concurrent use.
+type Cache struct {
+	mut     sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func NewCache() *Cache {
+	return &Cache{
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// Load returns the compiled Matcher for file, reusing a cached one if file
+// hasn't changed since it was last compiled. base is passed through to
+// Load and is not part of the cache key, since a given filesystem path is
+// only ever loaded with one base within a single scan. It returns a nil
+// Matcher and a nil error if file doesn't exist.
+func (c *Cache) Load(file, base string) (*Matcher, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		abs = file
+	}
+
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		c.mut.Lock()
+		delete(c.entries, abs)
+		c.mut.Unlock()
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if e, ok := c.entries[abs]; ok && e.mtime.Equal(info.ModTime()) && e.size == info.Size() {
+		return e.matcher, nil
+	}
+
+	matcher, err := Load(file, base)
+	if err != nil {
+		return nil, err
+	}
+
+	c.entries[abs] = cacheEntry{
+		mtime:   info.ModTime(),
+		size:    info.Size(),
+		matcher: matcher,
+	}
+
+	return matcher, nil
+}
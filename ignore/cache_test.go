@@ -0,0 +1,59 @@
+package ignore_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/syncthing/ignore"
+)
+
+// benchmarkCache scans a synthetic tree of numDirs directories, each with
+// its own .stignore, b.N times. useCache selects between recompiling every
+// file on every scan (the old behaviour) and going through a Cache (the new
+// behaviour), so -benchmem shows the drop in allocations that skipping
+// recompilation brings.
+func benchmarkCache(b *testing.B, numDirs int, useCache bool) {
+	tmp, err := ioutil.TempDir("", "ignore-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	files := make([]string, numDirs)
+	for i := 0; i < numDirs; i++ {
+		dir := filepath.Join(tmp, fmt.Sprintf("dir%d", i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		file := filepath.Join(dir, ".stignore")
+		if err := ioutil.WriteFile(file, []byte("*.tmp\n!keep.tmp\n"), 0644); err != nil {
+			b.Fatal(err)
+		}
+		files[i] = file
+	}
+
+	cache := ignore.NewCache()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, file := range files {
+			if useCache {
+				if _, err := cache.Load(file, "."); err != nil {
+					b.Fatal(err)
+				}
+			} else if _, err := ignore.Load(file, "."); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkLoad10k(b *testing.B)      { benchmarkCache(b, 10000, false) }
+func BenchmarkCacheLoad10k(b *testing.B) { benchmarkCache(b, 10000, true) }
+
+func BenchmarkLoad100k(b *testing.B)      { benchmarkCache(b, 100000, false) }
+func BenchmarkCacheLoad100k(b *testing.B) { benchmarkCache(b, 100000, true) }
@@ -17,23 +17,125 @@ import (
 	"github.com/syncthing/syncthing/fnmatch"
 )
 
-type Patterns []*regexp.Regexp
-
-func Load(file string) (Patterns, error) {
-	base := filepath.Dir(file)
-	seen := make(map[string]bool)
-	return loadIgnoreFile(file, base, seen)
+// Pattern is a single compiled ignore pattern. If negate is set, a file
+// matching the pattern is re-included rather than ignored. If dirsOnly is
+// set, the pattern only applies to directories.
+type Pattern struct {
+	match    *regexp.Regexp
+	negate   bool
+	dirsOnly bool
 }
 
+type Patterns []Pattern
+
+// Match returns true if file should be ignored. It is equivalent to
+// MatchFile(file, false); use MatchFile directly for patterns restricted to
+// directories.
 func (l Patterns) Match(file string) bool {
+	return l.MatchFile(file, false)
+}
+
+// MatchFile returns true if file should be ignored. Patterns are
+// considered in order, and the last matching pattern wins; a negated
+// pattern that matches last means the file is not ignored, even if an
+// earlier pattern matched. Patterns restricted to directories are only
+// considered when isDir is true.
+func (l Patterns) MatchFile(file string, isDir bool) bool {
+	var ignored bool
 	for _, pattern := range l {
-		if pattern.MatchString(file) {
+		if pattern.dirsOnly && !isDir {
+			continue
+		}
+		if pattern.match.MatchString(file) {
+			ignored = !pattern.negate
+		}
+	}
+	return ignored
+}
+
+// HasNegate returns true if any pattern in l is a negate ("!") pattern.
+func (l Patterns) HasNegate() bool {
+	for _, pattern := range l {
+		if pattern.negate {
 			return true
 		}
 	}
 	return false
 }
 
+// Matcher holds a compiled set of ignore patterns and is the single type
+// that callers outside this package should use to test files against an
+// ignore file.
+type Matcher struct {
+	patterns Patterns
+}
+
+// Load reads and compiles the ignore file at the given filesystem path,
+// following any #include directives relative to it. base is the directory
+// the compiled patterns are considered relative to when later matched
+// (typically "." for an ignore file at the root of the tree being
+// matched, or the root-relative path of the directory it lives in), which
+// need not be related to file's own location on disk.
+func Load(file, base string) (*Matcher, error) {
+	seen := make(map[string]bool)
+	patterns, err := loadIgnoreFile(file, base, seen)
+	if err != nil {
+		return nil, err
+	}
+	return &Matcher{patterns: patterns}, nil
+}
+
+// Parse reads and compiles ignore patterns from r. currentFile is used to
+// resolve #include directives and to detect include recursion; it need not
+// exist on disk.
+func Parse(r io.Reader, currentFile string) (*Matcher, error) {
+	seen := map[string]bool{currentFile: true}
+	patterns, err := parseIgnoreFile(r, filepath.Dir(currentFile), currentFile, seen)
+	if err != nil {
+		return nil, err
+	}
+	return &Matcher{patterns: patterns}, nil
+}
+
+// Combine returns a single Matcher equivalent to applying each of the given
+// matchers in order, so that patterns in a later matcher override matches
+// from an earlier one. Nil matchers are ignored.
+func Combine(matchers ...*Matcher) *Matcher {
+	var combined Patterns
+	for _, m := range matchers {
+		if m == nil {
+			continue
+		}
+		combined = append(combined, m.patterns...)
+	}
+	return &Matcher{patterns: combined}
+}
+
+// Match returns true if file should be ignored according to m.
+func (m *Matcher) Match(file string) bool {
+	return m.MatchFile(file, false)
+}
+
+// MatchFile returns true if file should be ignored according to m. isDir
+// must reflect whether file is a directory, so that directory-only
+// patterns (a trailing "/" in the ignore file) are applied correctly.
+func (m *Matcher) MatchFile(file string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	return m.patterns.MatchFile(file, isDir)
+}
+
+// HasNegate returns true if m contains any negate ("!") pattern, meaning a
+// directory that m considers ignored may still have descendants that a
+// later pattern re-includes, and so must not be pruned outright.
+func (m *Matcher) HasNegate() bool {
+	if m == nil {
+		return false
+	}
+	return m.patterns.HasNegate()
+}
+
 func loadIgnoreFile(file, base string, seen map[string]bool) (Patterns, error) {
 
 	if seen[file] {
@@ -59,48 +161,113 @@ func parseIgnoreFile(fd io.Reader, base, currentFile string, seen map[string]boo
 			continue
 		}
 
+		if strings.HasPrefix(line, "#include ") {
+			includeFile := filepath.Join(filepath.Dir(currentFile), line[len("#include "):])
+			includes, err := loadIgnoreFile(includeFile, base, seen)
+			if err != nil {
+				return nil, err
+			} else {
+				exps = append(exps, includes...)
+			}
+			continue
+		}
+
+		// A leading "#" marks a comment, unless escaped as "\#" for a
+		// literal leading "#".
+		if strings.HasPrefix(line, "\\#") {
+			line = line[1:]
+		} else if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// A leading "!" marks a negated (re-include) pattern, while a
+		// leading "\!" is an escape for a literal "!" at the start of the
+		// pattern.
+		negate := false
+		switch {
+		case strings.HasPrefix(line, "\\!"):
+			line = line[1:]
+		case strings.HasPrefix(line, "!"):
+			negate = true
+			line = line[1:]
+		}
+
+		// A leading "(?i)" makes the pattern case insensitive, useful on
+		// case-insensitive filesystems.
+		flags := fnmatch.FNM_PATHNAME
+		if strings.HasPrefix(line, "(?i)") {
+			flags |= fnmatch.FNM_CASEFOLD
+			line = line[4:]
+		}
+
+		// A trailing "/" restricts the pattern to directories only.
+		dirsOnly := false
+		if strings.HasSuffix(line, "/") {
+			dirsOnly = true
+			line = line[:len(line)-1]
+		}
+
 		if strings.HasPrefix(line, "/") {
-			// Pattern is rooted in the current dir only
-			exp, err := fnmatch.Convert(path.Join(base, line[1:]), fnmatch.FNM_PATHNAME)
+			// Pattern is rooted in the current dir only. Ignoring a
+			// directory also ignores everything underneath it, so match
+			// both the name itself and anything below it. dirsOnly only
+			// makes sense for the name itself; its contents are files and
+			// directories alike, so the "**" variant must not inherit it.
+			exp, err := fnmatch.Convert(path.Join(base, line[1:]), flags)
 			if err != nil {
 				return nil, fmt.Errorf("Invalid pattern %q in ignore file", line)
 			}
-			exps = append(exps, exp)
+			exps = append(exps, Pattern{exp, negate, dirsOnly})
+
+			exp, err = fnmatch.Convert(path.Join(base, line[1:], "**"), flags)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid pattern %q in ignore file", line)
+			}
+			exps = append(exps, Pattern{exp, negate, false})
 		} else if strings.HasPrefix(line, "**/") {
 			// Add the pattern as is, and without **/ so it matches in current dir
-			exp, err := fnmatch.Convert(line, fnmatch.FNM_PATHNAME)
+			exp, err := fnmatch.Convert(line, flags)
 			if err != nil {
 				return nil, fmt.Errorf("Invalid pattern %q in ignore file", line)
 			}
-			exps = append(exps, exp)
+			exps = append(exps, Pattern{exp, negate, dirsOnly})
 
-			exp, err = fnmatch.Convert(path.Join(base, line[3:]), fnmatch.FNM_PATHNAME)
+			exp, err = fnmatch.Convert(path.Join(base, line[3:]), flags)
 			if err != nil {
 				return nil, fmt.Errorf("Invalid pattern %q in ignore file", line)
 			}
-			exps = append(exps, exp)
-		} else if strings.HasPrefix(line, "#include ") {
-			includeFile := filepath.Join(filepath.Dir(currentFile), line[len("#include "):])
-			includes, err := loadIgnoreFile(includeFile, base, seen)
-			if err != nil {
-				return nil, err
-			} else {
-				exps = append(exps, includes...)
-			}
+			exps = append(exps, Pattern{exp, negate, dirsOnly})
 		} else {
 			// Path name or pattern, add it so it matches files both in
-			// current directory and subdirs.
-			exp, err := fnmatch.Convert(path.Join(base, line), fnmatch.FNM_PATHNAME)
+			// current directory and subdirs. Ignoring a directory also
+			// ignores everything underneath it, so match both the name
+			// itself and anything below it. Only the name-itself variants
+			// carry dirsOnly; the "**" contents variants must match files
+			// too, or a directory-only rule would never ignore anything
+			// inside the directory it names.
+			exp, err := fnmatch.Convert(path.Join(base, line), flags)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid pattern %q in ignore file", line)
+			}
+			exps = append(exps, Pattern{exp, negate, dirsOnly})
+
+			exp, err = fnmatch.Convert(path.Join(base, line, "**"), flags)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid pattern %q in ignore file", line)
+			}
+			exps = append(exps, Pattern{exp, negate, false})
+
+			exp, err = fnmatch.Convert(path.Join(base, "**", line), flags)
 			if err != nil {
 				return nil, fmt.Errorf("Invalid pattern %q in ignore file", line)
 			}
-			exps = append(exps, exp)
+			exps = append(exps, Pattern{exp, negate, dirsOnly})
 
-			exp, err = fnmatch.Convert(path.Join(base, "**", line), fnmatch.FNM_PATHNAME)
+			exp, err = fnmatch.Convert(path.Join(base, "**", line, "**"), flags)
 			if err != nil {
 				return nil, fmt.Errorf("Invalid pattern %q in ignore file", line)
 			}
-			exps = append(exps, exp)
+			exps = append(exps, Pattern{exp, negate, false})
 		}
 	}
 
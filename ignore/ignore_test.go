@@ -9,7 +9,7 @@ import (
 )
 
 func TestIgnore(t *testing.T) {
-	pats, err := ignore.Load("testdata/.stignore")
+	pats, err := ignore.Load("testdata/.stignore", ".")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -39,6 +39,31 @@ func TestIgnore(t *testing.T) {
 
 		{filepath.Join("dir3"), true},
 		{filepath.Join("dir3", "afile"), true},
+
+		// Re-inclusion with "!"
+		{filepath.Join("build", "other.txt"), true},
+		{filepath.Join("build", "keep.txt"), false},
+
+		// Re-inclusion of a "**/"-rooted pattern
+		{filepath.Join("node_modules", "foo"), true},
+		{filepath.Join("node_modules", "keep"), false},
+		{filepath.Join("sub", "node_modules", "foo"), true},
+		{filepath.Join("sub", "node_modules", "keep"), false},
+
+		// Negation inside an #include'd file
+		{filepath.Join("included", "other.txt"), true},
+		{filepath.Join("included", "keep.txt"), false},
+
+		// "\!" is a literal "!", not a negation
+		{"!important", true},
+
+		// "#" starts a comment, "\#" is a literal "#"
+		{"# a comment line, ignored entirely", false},
+		{"#keep.txt", true},
+
+		// "(?i)" makes the pattern case insensitive
+		{"casefile", true},
+		{"CaseFile", true},
 	}
 
 	for i, tc := range tests {
@@ -48,6 +73,29 @@ func TestIgnore(t *testing.T) {
 	}
 }
 
+func TestIgnoreDirsOnly(t *testing.T) {
+	pats, err := ignore.Load("testdata/.stignore", ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		f     string
+		isDir bool
+		r     bool
+	}{
+		{"onlydir", true, true},
+		{"onlydir", false, false},
+		{filepath.Join("onlydir", "file"), false, true},
+	}
+
+	for i, tc := range tests {
+		if r := pats.MatchFile(tc.f, tc.isDir); r != tc.r {
+			t.Errorf("Incorrect MatchFile() #%d (%s, isDir=%v); E: %v, A: %v", i, tc.f, tc.isDir, tc.r, r)
+		}
+	}
+}
+
 func TestBadPatterns(t *testing.T) {
 	var badPatterns = []string{
 		"[",
@@ -55,6 +103,8 @@ func TestBadPatterns(t *testing.T) {
 		"**/[",
 		"#include nonexistent",
 		"#include .stignore",
+		"![",
+		"(?i)[",
 	}
 
 	for _, pat := range badPatterns {
@@ -5,23 +5,28 @@
 package scanner
 
 import (
-	"bufio"
 	"errors"
-	"io"
 	"os"
-	"path"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"strings"
 
 	"code.google.com/p/go.text/unicode/norm"
 
-	"github.com/syncthing/syncthing/fnmatch"
+	"github.com/syncthing/syncthing/ignore"
 	"github.com/syncthing/syncthing/lamport"
 	"github.com/syncthing/syncthing/protocol"
 )
 
+// matcherFrame is one level of the directory-scoped ignore stack built up
+// while walking: matcher is the combination of dir's own ignore file (if
+// any) with every ancestor's, so a file is tested against exactly the
+// rules that apply to the directory it lives in.
+type matcherFrame struct {
+	dir     string
+	matcher *ignore.Matcher
+}
+
 type Walker struct {
 	// Dir is the base directory for the walk
 	Dir string
@@ -39,6 +44,10 @@ type Walker struct {
 	// detected. Scanned files will get zero permission bits and the
 	// NoPermissionBits flag set.
 	IgnorePerms bool
+
+	// ignoreCache caches compiled ignore patterns across calls to Walk, so
+	// that repeated scans only recompile the ignore files that changed.
+	ignoreCache *ignore.Cache
 }
 
 type TempNamer interface {
@@ -65,15 +74,16 @@ func (w *Walker) Walk() (chan protocol.FileInfo, error) {
 		return nil, err
 	}
 
+	if w.ignoreCache == nil {
+		w.ignoreCache = ignore.NewCache()
+	}
+
 	files := make(chan protocol.FileInfo)
 	hashedFiles := make(chan protocol.FileInfo)
 	newParallelHasher(w.Dir, w.BlockSize, runtime.NumCPU(), hashedFiles, files)
 
-	var ignores []*regexp.Regexp
 	go func() {
-		filepath.Walk(w.Dir, w.loadIgnoreFiles(w.Dir, &ignores))
-
-		hashFiles := w.walkAndHashFiles(files, ignores)
+		hashFiles := w.walkAndHashFiles(files)
 		filepath.Walk(filepath.Join(w.Dir, w.Sub), hashFiles)
 		close(files)
 	}()
@@ -86,113 +96,54 @@ func (w *Walker) CleanTempFiles() {
 	filepath.Walk(w.Dir, w.cleanTempFile)
 }
 
-func (w *Walker) loadIgnoreFiles(dir string, ignores *[]*regexp.Regexp) filepath.WalkFunc {
-	return func(p string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
+// initialStack builds the ignore stack for the root of w.Dir and every
+// directory between it and w.Sub (w.Sub itself excluded, unless it is the
+// root), so that a scan restricted to a subdirectory still honours ignore
+// files above it.
+func (w *Walker) initialStack() []matcherFrame {
+	root, err := w.ignoreCache.Load(filepath.Join(w.Dir, w.IgnoreFile), ".")
+	if err != nil {
+		l.Warnln("Loading ignores:", err)
+	}
+	stack := []matcherFrame{{dir: ".", matcher: root}}
 
-		rn, err := filepath.Rel(dir, p)
-		if err != nil {
-			return nil
-		}
+	sub := filepath.Clean(w.Sub)
+	if sub == "" || sub == "." {
+		return stack
+	}
 
-		if pn, sn := filepath.Split(rn); sn == w.IgnoreFile {
-			pn := filepath.Clean(pn)
-			filesSeen := make(map[string]map[string]bool)
-			dirIgnores := loadIgnoreFile(p, pn, filesSeen)
-			*ignores = append(*ignores, dirIgnores...)
+	parts := strings.Split(sub, string(filepath.Separator))
+	dir := "."
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		own, err := w.ignoreCache.Load(filepath.Join(w.Dir, dir, w.IgnoreFile), dir)
+		if err != nil {
+			l.Warnln("Loading ignores:", err)
 		}
-
-		return nil
+		stack = append(stack, matcherFrame{dir: dir, matcher: ignore.Combine(stack[len(stack)-1].matcher, own)})
 	}
+
+	return stack
 }
 
-func loadIgnoreFile(ignFile, base string, filesSeen map[string]map[string]bool) []*regexp.Regexp {
-	fd, err := os.Open(ignFile)
+// pushIgnoreFrame loads dir's own ignore file (if any) through the cache
+// and appends a frame for it onto stack, combined with parent. A directory
+// without its own ignore file reuses parent unchanged, avoiding an
+// allocation on the common case.
+func (w *Walker) pushIgnoreFrame(stack []matcherFrame, p, dir, rn string, parent *ignore.Matcher) []matcherFrame {
+	own, err := w.ignoreCache.Load(filepath.Join(p, w.IgnoreFile), dir)
 	if err != nil {
-		return nil
+		l.Warnln("Loading ignores:", err)
 	}
-	defer fd.Close()
-	return parseIgnoreFile(fd, base, ignFile, filesSeen)
-}
-
-func parseIgnoreFile(fd io.Reader, base, currentFile string, filesSeen map[string]map[string]bool) []*regexp.Regexp {
-	var exps []*regexp.Regexp
-	scanner := bufio.NewScanner(fd)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
-		}
-
-		if strings.HasPrefix(line, "/") {
-			// Pattern is rooted in the current dir only
-			exp, err := fnmatch.Convert(path.Join(base, line[1:]), fnmatch.FNM_PATHNAME)
-			if err != nil {
-				l.Warnf("Invalid pattern %q in ignore file", line)
-				continue
-			}
-			exps = append(exps, exp)
-		} else if strings.HasPrefix(line, "**/") {
-			// Add the pattern as is, and without **/ so it matches in current dir
-			exp, err := fnmatch.Convert(line, fnmatch.FNM_PATHNAME)
-			if err != nil {
-				l.Warnf("Invalid pattern %q in ignore file", line)
-				continue
-			}
-			exps = append(exps, exp)
-
-			exp, err = fnmatch.Convert(path.Join(base, line[3:]), fnmatch.FNM_PATHNAME)
-			if err != nil {
-				l.Warnf("Invalid pattern %q in ignore file", line)
-				continue
-			}
-			exps = append(exps, exp)
-		} else if strings.HasPrefix(line, "#include ") {
-			includeFile := filepath.Join(filepath.Dir(currentFile), strings.Replace(line, "#include ", "", 1))
-			if _, err := os.Stat(includeFile); os.IsNotExist(err) {
-				l.Infoln("Could not open ignore include file", includeFile)
-			} else {
-				seen := false
-				if seenByCurrent, ok := filesSeen[currentFile]; ok {
-					_, seen = seenByCurrent[includeFile]
-				}
-
-				if seen {
-					l.Warnf("Recursion detected while including %s from %s", includeFile, currentFile)
-				} else {
-					if filesSeen[currentFile] == nil {
-						filesSeen[currentFile] = make(map[string]bool)
-					}
-					filesSeen[currentFile][includeFile] = true
-					includes := loadIgnoreFile(includeFile, base, filesSeen)
-					exps = append(exps, includes...)
-				}
-			}
-		} else {
-			// Path name or pattern, add it so it matches files both in
-			// current directory and subdirs.
-			exp, err := fnmatch.Convert(path.Join(base, line), fnmatch.FNM_PATHNAME)
-			if err != nil {
-				l.Warnf("Invalid pattern %q in ignore file", line)
-				continue
-			}
-			exps = append(exps, exp)
-
-			exp, err = fnmatch.Convert(path.Join(base, "**", line), fnmatch.FNM_PATHNAME)
-			if err != nil {
-				l.Warnf("Invalid pattern %q in ignore file", line)
-				continue
-			}
-			exps = append(exps, exp)
-		}
+	if own == nil {
+		return append(stack, matcherFrame{dir: rn, matcher: parent})
 	}
-
-	return exps
+	return append(stack, matcherFrame{dir: rn, matcher: ignore.Combine(parent, own)})
 }
 
-func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo, ignores []*regexp.Regexp) filepath.WalkFunc {
+func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFunc {
+	stack := w.initialStack()
+
 	return func(p string, info os.FileInfo, err error) error {
 		if err != nil {
 			if debug {
@@ -213,6 +164,15 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo, ignores []*regex
 			return nil
 		}
 
+		dir := rn
+		if !info.IsDir() {
+			dir = filepath.Dir(rn)
+		}
+		for len(stack) > 1 && !isAncestorDir(stack[len(stack)-1].dir, dir) {
+			stack = stack[:len(stack)-1]
+		}
+		matcher := stack[len(stack)-1].matcher
+
 		if w.TempNamer != nil && w.TempNamer.IsTemporary(rn) {
 			// A temporary file
 			if debug {
@@ -221,17 +181,29 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo, ignores []*regex
 			return nil
 		}
 
-		if sn := filepath.Base(rn); sn == w.IgnoreFile || sn == ".stversions" || w.ignoreFile(ignores, rn) {
+		if sn := filepath.Base(rn); sn == w.IgnoreFile || sn == ".stversions" || matcher.MatchFile(rn, info.IsDir()) {
 			// An ignored file
 			if debug {
 				l.Debugln("ignored:", rn)
 			}
 			if info.IsDir() {
-				return filepath.SkipDir
+				if !matcher.HasNegate() {
+					return filepath.SkipDir
+				}
+				// A negate pattern could still re-include one of this
+				// directory's descendants, so keep walking into it
+				// instead of pruning the whole subtree; the directory
+				// itself is not reported, since it matched an ignore
+				// pattern.
+				stack = w.pushIgnoreFrame(stack, p, dir, rn, matcher)
 			}
 			return nil
 		}
 
+		if info.IsDir() {
+			stack = w.pushIgnoreFrame(stack, p, dir, rn, matcher)
+		}
+
 		if (runtime.GOOS == "linux" || runtime.GOOS == "windows") && !norm.NFC.IsNormalString(rn) {
 			l.Warnf("File %q contains non-NFC UTF-8 sequences and cannot be synced. Consider renaming.", rn)
 			return nil
@@ -305,16 +277,13 @@ func (w *Walker) cleanTempFile(path string, info os.FileInfo, err error) error {
 	return nil
 }
 
-func (w *Walker) ignoreFile(patterns []*regexp.Regexp, file string) bool {
-	for _, pattern := range patterns {
-		if pattern.MatchString(file) {
-			if debug {
-				l.Debugf("%q matches %v", file, pattern)
-			}
-			return true
-		}
+// isAncestorDir returns true if parent is child itself or one of child's
+// ancestors, i.e. child is parent or lives somewhere underneath it.
+func isAncestorDir(parent, child string) bool {
+	if parent == "." {
+		return true
 	}
-	return false
+	return child == parent || strings.HasPrefix(child, parent+string(filepath.Separator))
 }
 
 func checkDir(dir string) error {
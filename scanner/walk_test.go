@@ -0,0 +1,122 @@
+package scanner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWalkNestedIgnore verifies that a rule in a nested .stignore only
+// applies under the directory it lives in, and does not leak to sibling
+// directories or override the root ignore file.
+func TestWalkNestedIgnore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "walk-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	files := map[string]string{
+		".stignore":             "ignored-root.txt\n",
+		"ignored-root.txt":      "x",
+		"kept-root.txt":         "x",
+		"sub/.stignore":         "ignored-sub.txt\n",
+		"sub/ignored-sub.txt":   "x",
+		"sub/kept-sub.txt":      "x",
+		"other/ignored-sub.txt": "x",
+	}
+	for name, content := range files {
+		p := filepath.Join(tmp, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := &Walker{
+		Dir:        tmp,
+		BlockSize:  128 * 1024,
+		IgnoreFile: ".stignore",
+	}
+
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for f := range fchan {
+		seen[filepath.ToSlash(f.Name)] = true
+	}
+
+	for _, name := range []string{"kept-root.txt", "sub", "sub/kept-sub.txt", "other", "other/ignored-sub.txt"} {
+		if !seen[name] {
+			t.Errorf("expected %q to be scanned, but it was not", name)
+		}
+	}
+
+	for _, name := range []string{"ignored-root.txt", "sub/ignored-sub.txt"} {
+		if seen[name] {
+			t.Errorf("expected %q to be ignored, but it was scanned", name)
+		}
+	}
+}
+
+// TestWalkNegateReIncludesFile verifies the headline negation use case end
+// to end through the real walk, not just against Patterns.Match: a whole
+// directory ignored by one pattern can still have a specific file inside
+// it re-included by a later "!" pattern.
+func TestWalkNegateReIncludesFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "walk-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	files := map[string]string{
+		".stignore":           "build\n!build/keep.txt\n",
+		"build/other.txt":     "x",
+		"build/keep.txt":      "x",
+		"build/sub/other.txt": "x",
+	}
+	for name, content := range files {
+		p := filepath.Join(tmp, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := &Walker{
+		Dir:        tmp,
+		BlockSize:  128 * 1024,
+		IgnoreFile: ".stignore",
+	}
+
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for f := range fchan {
+		seen[filepath.ToSlash(f.Name)] = true
+	}
+
+	if !seen["build/keep.txt"] {
+		t.Error("expected build/keep.txt to be re-included by the negate pattern, but it was not scanned")
+	}
+	if seen["build"] {
+		t.Error("expected the ignored build directory itself not to be reported")
+	}
+	for _, name := range []string{"build/other.txt", "build/sub/other.txt"} {
+		if seen[name] {
+			t.Errorf("expected %q to stay ignored, but it was scanned", name)
+		}
+	}
+}